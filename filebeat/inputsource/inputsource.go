@@ -0,0 +1,58 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package inputsource defines the common types shared by the network based
+// inputsources (tcp, udp, unix sockets).
+package inputsource
+
+import "net"
+
+const (
+	// FamilyUnix identifies inputsources listening on a unix socket.
+	FamilyUnix = "unix"
+
+	// FamilyTCP identifies inputsources listening on a TCP socket.
+	FamilyTCP = "tcp"
+
+	// FamilyUDP identifies inputsources listening on a UDP socket.
+	FamilyUDP = "udp"
+)
+
+// Network is implemented by every inputsource that accepts connections or
+// packets on a network interface.
+type Network interface {
+	Start() error
+	Stop() error
+}
+
+// NetworkMetadata bundles together metadata captured while receiving an
+// event over the network.
+type NetworkMetadata struct {
+	RemoteAddr net.Addr
+	Truncated  bool
+	TLSPeer    *TLSPeerMetadata
+}
+
+// TLSPeerMetadata carries the identity presented by a client that
+// authenticated with a TLS client (peer) certificate.
+type TLSPeerMetadata struct {
+	Subject  string
+	DNSNames []string
+}
+
+// NetworkFunc is invoked for every event received by a network inputsource.
+type NetworkFunc func(data []byte, metadata NetworkMetadata)
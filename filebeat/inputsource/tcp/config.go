@@ -0,0 +1,78 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tcp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common/transport/tlscommon"
+)
+
+// Config exposes the configuration options of the tcp inputsource.
+type Config struct {
+	LineDelimiter  string                  `config:"line_delimiter"`
+	Framing        string                  `config:"framing"`
+	Timeout        time.Duration           `config:"timeout" validate:"min=1"`
+	MaxMessageSize int                     `config:"max_read_message" validate:"min=1"`
+	MaxConnections int                     `config:"max_connections" validate:"min=0"`
+	Host           string                  `config:"host" validate:"required"`
+	TLS            *tlscommon.ServerConfig `config:"ssl"`
+
+	// MaxBytesPerSecond caps the aggregate read throughput across every
+	// connection accepted by the Server. 0 disables the limit.
+	MaxBytesPerSecond int64 `config:"max_bytes_per_second" validate:"min=0"`
+
+	// MaxBytesPerConnectionPerSecond caps the read throughput of a single
+	// connection. 0 disables the limit.
+	MaxBytesPerConnectionPerSecond int64 `config:"max_bytes_per_connection_per_second" validate:"min=0"`
+
+	// MaxConnectionsPerIP caps how many connections a single remote IP may
+	// hold open concurrently. 0 disables the limit.
+	MaxConnectionsPerIP int `config:"max_connections_per_ip" validate:"min=0"`
+
+	// OverflowAction controls what happens to a newly accepted connection
+	// once MaxConnections is reached: "wait" (the default) blocks the
+	// connection until a slot frees up, "reject" closes it immediately.
+	OverflowAction string `config:"overflow_action"`
+
+	// ShutdownTimeout bounds how long Stop waits for in-flight connections
+	// to drain before returning. 0 means wait indefinitely.
+	ShutdownTimeout time.Duration `config:"shutdown_timeout" validate:"min=0"`
+}
+
+// Validate validates the config.
+func (c *Config) Validate() error {
+	if c.TLS.IsEnabled() && c.TLS.ClientAuth == tlscommon.TLSClientAuthRequired && len(c.TLS.CAs) == 0 {
+		return fmt.Errorf("client_authentication is required but no certificate_authorities are configured")
+	}
+
+	switch c.Framing {
+	case "", FramingDelimiter, FramingOctetCount:
+	default:
+		return fmt.Errorf("framing must be either %q or %q, got %q", FramingDelimiter, FramingOctetCount, c.Framing)
+	}
+
+	switch c.OverflowAction {
+	case "", OverflowActionWait, OverflowActionReject:
+	default:
+		return fmt.Errorf("overflow_action must be either %q or %q, got %q", OverflowActionWait, OverflowActionReject, c.OverflowAction)
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tcp
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	// OverflowActionWait blocks a newly accepted connection until a
+	// concurrency slot frees up.
+	OverflowActionWait = "wait"
+
+	// OverflowActionReject closes a newly accepted connection immediately
+	// once the concurrency limit is reached.
+	OverflowActionReject = "reject"
+)
+
+// connLimiter bounds how many connections the Server handles concurrently,
+// both in total and per remote IP.
+type connLimiter struct {
+	overflowAction string
+
+	slots chan struct{} // nil when MaxConnections is 0 (unbounded)
+
+	maxPerIP int
+	mu       sync.Mutex
+	perIP    map[string]int
+}
+
+func newConnLimiter(config *Config) *connLimiter {
+	l := &connLimiter{
+		overflowAction: config.OverflowAction,
+		maxPerIP:       config.MaxConnectionsPerIP,
+		perIP:          make(map[string]int),
+	}
+
+	if config.MaxConnections > 0 {
+		l.slots = make(chan struct{}, config.MaxConnections)
+	}
+
+	return l
+}
+
+// acquire reserves a slot for conn, blocking or rejecting as configured by
+// overflowAction when the global limit is already reached. It returns false
+// when the connection must be refused (either its IP already holds
+// max_connections_per_ip connections, or the global limit was reached and
+// overflow_action is "reject"). done is closed when the server is stopping,
+// so a connection blocked waiting for a slot doesn't leak; acquire then
+// returns false as well.
+func (l *connLimiter) acquire(conn net.Conn, done <-chan struct{}) bool {
+	ip := remoteIP(conn)
+
+	// Reserve the per-IP slot speculatively in the same critical section as
+	// the check, so two concurrent connections from the same IP can't both
+	// observe room and both proceed. If the global slot acquisition below
+	// fails, the reservation is rolled back.
+	l.mu.Lock()
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		l.mu.Unlock()
+		return false
+	}
+	l.perIP[ip]++
+	l.mu.Unlock()
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if l.overflowAction == OverflowActionReject {
+				l.releaseIP(ip)
+				return false
+			}
+			select {
+			case l.slots <- struct{}{}:
+			case <-done:
+				l.releaseIP(ip)
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// releaseIP rolls back the per-IP reservation taken by acquire.
+func (l *connLimiter) releaseIP(ip string) {
+	l.mu.Lock()
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	l.mu.Unlock()
+}
+
+// release returns conn's slot, making room for another connection.
+func (l *connLimiter) release(conn net.Conn) {
+	l.releaseIP(remoteIP(conn))
+
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// unknownRemoteIP is the per-IP bucket key used for addresses that can't be
+// split into host and port. Bucketing these together (rather than by the
+// unparsed address itself) keeps the fallback fail-safe: a connection whose
+// address doesn't parse can't get a private bucket that bypasses
+// max_connections_per_ip.
+const unknownRemoteIP = "unknown"
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return unknownRemoteIP
+	}
+	return host
+}
@@ -0,0 +1,158 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tcp
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// emaSampleInterval is how often a throughputMonitor recomputes its
+// exponential moving average transfer rate.
+const emaSampleInterval = 100 * time.Millisecond
+
+// emaTau is the smoothing time constant used to derive the EMA weight:
+// a = 1 - exp(-emaSampleInterval/emaTau).
+const emaTau = time.Second
+
+// Stats is a snapshot of the throughput observed by a Server, suitable for
+// publishing through libbeat monitoring.
+type Stats struct {
+	EMABytesPerSecond  float64
+	PeakBytesPerSecond float64
+	TotalBytes         int64
+	ActiveDuration     time.Duration
+}
+
+// throughputMonitor tracks the byte rate observed on a stream, and, when
+// limit is positive, enforces it by sleeping inside observe.
+type throughputMonitor struct {
+	limit float64 // bytes/sec; 0 disables enforcement
+
+	mu          sync.Mutex
+	ema         float64
+	peak        float64
+	totalBytes  int64
+	activeSince time.Time // zero until the first byte is observed
+	sampleBytes int64
+	sampleStart time.Time
+}
+
+func newThroughputMonitor(limitBytesPerSecond float64) *throughputMonitor {
+	return &throughputMonitor{
+		limit:       limitBytesPerSecond,
+		sampleStart: time.Now(),
+	}
+}
+
+// Stats returns a snapshot of the monitor's counters. ActiveDuration is the
+// time since data first flowed through the monitor, and is zero if none has
+// yet.
+func (m *throughputMonitor) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var active time.Duration
+	if !m.activeSince.IsZero() {
+		active = time.Since(m.activeSince)
+	}
+
+	return Stats{
+		EMABytesPerSecond:  m.ema,
+		PeakBytesPerSecond: m.peak,
+		TotalBytes:         m.totalBytes,
+		ActiveDuration:     active,
+	}
+}
+
+// observe records n bytes transferred, updating the EMA rate at most once
+// per emaSampleInterval. It never sleeps; use throttleDelay to find out how
+// long the caller should wait.
+func (m *throughputMonitor) observe(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.activeSince.IsZero() {
+		m.activeSince = time.Now()
+	}
+
+	m.totalBytes += int64(n)
+	m.sampleBytes += int64(n)
+
+	now := time.Now()
+	if since := now.Sub(m.sampleStart); since >= emaSampleInterval {
+		rSample := float64(m.sampleBytes) / since.Seconds()
+		a := 1 - math.Exp(-since.Seconds()/emaTau.Seconds())
+		m.ema += a * (rSample - m.ema)
+		if m.ema > m.peak {
+			m.peak = m.ema
+		}
+		m.sampleBytes = 0
+		m.sampleStart = now
+	}
+}
+
+// throttleDelay returns how long to sleep, after transferring n bytes in
+// elapsed wall-clock time, to keep this monitor's rate at or below its
+// limit. It returns 0 when the monitor has no limit configured.
+func (m *throughputMonitor) throttleDelay(n int, elapsed time.Duration) time.Duration {
+	m.mu.Lock()
+	limit := m.limit
+	m.mu.Unlock()
+
+	if limit <= 0 {
+		return 0
+	}
+
+	if sleep := float64(n)/limit - elapsed.Seconds(); sleep > 0 {
+		return time.Duration(sleep * float64(time.Second))
+	}
+	return 0
+}
+
+// meteredConn wraps a net.Conn and feeds every Read through one or more
+// throughputMonitors, so a single connection can be metered both against its
+// own per-connection limit and against a limit shared across the Server.
+// When more than one limit applies, the binding constraint is whichever
+// monitor demands the longest sleep, not the sum of all of them.
+type meteredConn struct {
+	net.Conn
+	monitors []*throughputMonitor
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		elapsed := time.Since(start)
+
+		var sleep time.Duration
+		for _, mon := range c.monitors {
+			mon.observe(n)
+			if delay := mon.throttleDelay(n, elapsed); delay > sleep {
+				sleep = delay
+			}
+		}
+		if sleep > 0 {
+			time.Sleep(sleep)
+		}
+	}
+	return n, err
+}
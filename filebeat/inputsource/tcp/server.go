@@ -0,0 +1,234 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tcp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/filebeat/inputsource"
+	"github.com/elastic/beats/libbeat/common/transport/tlscommon"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// Server is a TCP server that accepts connections, splits the incoming
+// stream using the configured split function and forwards every resulting
+// message to the configured callback.
+type Server struct {
+	Listener net.Listener
+
+	config    *Config
+	callback  inputsource.NetworkFunc
+	splitFunc bufio.SplitFunc
+	log       *logp.Logger
+
+	globalMonitor *throughputMonitor
+	connLimiter   *connLimiter
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New creates a new tcp server.
+func New(config *Config, splitFunc bufio.SplitFunc, callback inputsource.NetworkFunc) (*Server, error) {
+	return &Server{
+		config:        config,
+		splitFunc:     splitFunc,
+		callback:      callback,
+		log:           logp.NewLogger("tcp"),
+		globalMonitor: newThroughputMonitor(float64(config.MaxBytesPerSecond)),
+		connLimiter:   newConnLimiter(config),
+		conns:         make(map[net.Conn]struct{}),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// Stats returns the aggregate throughput observed across every connection
+// accepted by the server since it started.
+func (s *Server) Stats() Stats {
+	return s.globalMonitor.Stats()
+}
+
+// Start starts listening and accepting connections.
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.config.Host)
+	if err != nil {
+		return fmt.Errorf("can't start listening on %s: %v", s.config.Host, err)
+	}
+
+	if s.config.TLS.IsEnabled() {
+		tlsConfig, err := tlscommon.LoadTLSServerConfig(s.config.TLS)
+		if err != nil {
+			return fmt.Errorf("invalid tls configuration: %v", err)
+		}
+		l = tls.NewListener(l, tlsConfig.BuildModuleConfig(s.config.Host))
+	}
+
+	s.Listener = l
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run()
+	}()
+
+	return nil
+}
+
+func (s *Server) run() {
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+				s.log.Errorw("Error accepting connection", "error", err)
+				continue
+			}
+		}
+
+		if !s.connLimiter.acquire(conn, s.done) {
+			conn.Close()
+			continue
+		}
+
+		s.trackConn(conn)
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrackConn(conn)
+			defer s.connLimiter.release(conn)
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// trackConn registers conn as in-flight, so Stop can force it closed if it's
+// still open once the shutdown timeout elapses.
+func (s *Server) trackConn(conn net.Conn) {
+	s.connsMu.Lock()
+	s.conns[conn] = struct{}{}
+	s.connsMu.Unlock()
+}
+
+// untrackConn removes conn from the in-flight set once its handling
+// goroutine has finished with it.
+func (s *Server) untrackConn(conn net.Conn) {
+	s.connsMu.Lock()
+	delete(s.conns, conn)
+	s.connsMu.Unlock()
+}
+
+// closeOpenConns force-closes every connection still in the in-flight set,
+// reclaiming the socket instead of abandoning it. A handleConnection
+// goroutine blocked reading from the conn unblocks and exits once its read
+// errors out; one blocked inside the callback itself still has to wait for
+// the callback to return, same as before.
+func (s *Server) closeOpenConns() {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	metadata := inputsource.NetworkMetadata{RemoteAddr: conn.RemoteAddr()}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			s.log.Errorw("TLS handshake failed", "error", err, "remote_address", conn.RemoteAddr())
+			return
+		}
+
+		if peerCerts := tlsConn.ConnectionState().PeerCertificates; len(peerCerts) > 0 {
+			metadata.TLSPeer = &inputsource.TLSPeerMetadata{
+				Subject:  peerCerts[0].Subject.String(),
+				DNSNames: peerCerts[0].DNSNames,
+			}
+		}
+	}
+
+	metered := &meteredConn{
+		Conn: conn,
+		monitors: []*throughputMonitor{
+			s.globalMonitor,
+			newThroughputMonitor(float64(s.config.MaxBytesPerConnectionPerSecond)),
+		},
+	}
+
+	scanner := bufio.NewScanner(metered)
+	scanner.Buffer(make([]byte, 0, s.config.MaxMessageSize), s.config.MaxMessageSize)
+	scanner.Split(s.splitFunc)
+
+	for scanner.Scan() {
+		if s.config.Timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.config.Timeout))
+		}
+
+		data := scanner.Bytes()
+		message := make([]byte, len(data))
+		copy(message, data)
+
+		s.callback(message, metadata)
+	}
+
+	if err := scanner.Err(); err != nil {
+		s.log.Errorw("Error reading from connection", "error", err, "remote_address", conn.RemoteAddr())
+	}
+}
+
+// Stop closes the listener and waits for every in-flight connection to
+// terminate, up to the configured ShutdownTimeout. Connections still open
+// once the timeout elapses are force-closed rather than abandoned.
+func (s *Server) Stop() error {
+	close(s.done)
+	err := s.Listener.Close()
+
+	if s.config.ShutdownTimeout <= 0 {
+		s.wg.Wait()
+		return err
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(s.config.ShutdownTimeout):
+		s.log.Warnw("Stop timed out waiting for connections to drain, closing remaining connections", "timeout", s.config.ShutdownTimeout)
+		s.closeOpenConns()
+	}
+
+	return err
+}
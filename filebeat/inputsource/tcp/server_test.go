@@ -19,10 +19,22 @@ package tcp
 
 import (
 	"bufio"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -238,6 +250,651 @@ func TestReceiveNewEventsConcurrently(t *testing.T) {
 	}
 }
 
+func TestReceiveEventsAndMetadataTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-tls-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ca := generateTestCA(t, dir, "ca")
+	serverCertPath, serverKeyPath := generateTestCertificate(t, dir, "server", ca)
+	clientCertPath, clientKeyPath := generateTestCertificate(t, dir, "client", ca)
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name      string
+		sslConfig map[string]interface{}
+		dialTLS   *tls.Config
+		wantPeer  bool
+	}{
+		{
+			name: "ServerAuthOnly",
+			sslConfig: map[string]interface{}{
+				"enabled":     true,
+				"certificate": serverCertPath,
+				"key":         serverKeyPath,
+			},
+			dialTLS:  &tls.Config{InsecureSkipVerify: true},
+			wantPeer: false,
+		},
+		{
+			name: "MutualTLS",
+			sslConfig: map[string]interface{}{
+				"enabled":                 true,
+				"certificate":             serverCertPath,
+				"key":                     serverKeyPath,
+				"certificate_authorities": []string{ca.certPath},
+				"client_authentication":   "required",
+			},
+			dialTLS: &tls.Config{
+				InsecureSkipVerify: true,
+				Certificates:       []tls.Certificate{clientCert},
+			},
+			wantPeer: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ch := make(chan *info, 1)
+			defer close(ch)
+			to := func(message []byte, mt inputsource.NetworkMetadata) {
+				ch <- &info{message: string(message), mt: mt}
+			}
+
+			cfg, err := common.NewConfigFrom(map[string]interface{}{
+				"host": "localhost:0",
+				"ssl":  test.sslConfig,
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			config := defaultConfig
+			err = cfg.Unpack(&config)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			server, err := New(&config, SplitFunc([]byte("\n")), to)
+			if !assert.NoError(t, err) {
+				return
+			}
+			err = server.Start()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer server.Stop()
+
+			conn, err := tls.Dial("tcp", server.Listener.Addr().String(), test.dialTLS)
+			if !assert.NoError(t, err) {
+				return
+			}
+			fmt.Fprint(conn, "hello\n")
+			conn.Close()
+
+			select {
+			case event := <-ch:
+				assert.Equal(t, "hello", event.message)
+				assert.NotNil(t, event.mt.RemoteAddr)
+				if test.wantPeer {
+					if assert.NotNil(t, event.mt.TLSPeer) {
+						assert.NotEmpty(t, event.mt.TLSPeer.Subject)
+					}
+				} else {
+					assert.Nil(t, event.mt.TLSPeer)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for event")
+			}
+		})
+	}
+}
+
+func TestOctetCountFraming(t *testing.T) {
+	// With max_read_message set to 100 below, a message of 97 bytes produces
+	// a "97 "-prefixed frame that is exactly 100 bytes long - the largest
+	// frame that must still be accepted, since the limit bounds the whole
+	// frame (prefix included), not just the message body.
+	exactBoundaryMessage := randomString(97)
+
+	tests := []struct {
+		name             string
+		write            func(conn net.Conn)
+		expectedMessages []string
+	}{
+		{
+			name: "SingleMessageNoTrailingFrame",
+			write: func(conn net.Conn) {
+				fmt.Fprint(conn, "5 hello")
+			},
+			expectedMessages: []string{"hello"},
+		},
+		{
+			name: "BackToBackFrames",
+			write: func(conn net.Conn) {
+				fmt.Fprint(conn, "5 hello6 world!")
+			},
+			expectedMessages: []string{"hello", "world!"},
+		},
+		{
+			name: "FrameExactlyAtMaxMessageSize",
+			write: func(conn net.Conn) {
+				fmt.Fprintf(conn, "97 %s", exactBoundaryMessage)
+			},
+			expectedMessages: []string{exactBoundaryMessage},
+		},
+		{
+			name: "OversizedFrame",
+			write: func(conn net.Conn) {
+				fmt.Fprintf(conn, "1000 %s", randomString(1000))
+			},
+			expectedMessages: []string{},
+		},
+		{
+			name: "PartialFrameAcrossWrites",
+			write: func(conn net.Conn) {
+				fmt.Fprint(conn, "11 hello ")
+				time.Sleep(10 * time.Millisecond)
+				fmt.Fprint(conn, "world")
+			},
+			expectedMessages: []string{"hello world"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ch := make(chan *info, len(test.expectedMessages)+1)
+			defer close(ch)
+			to := func(message []byte, mt inputsource.NetworkMetadata) {
+				ch <- &info{message: string(message), mt: mt}
+			}
+
+			cfg, err := common.NewConfigFrom(map[string]interface{}{
+				"host":             "localhost:0",
+				"framing":          FramingOctetCount,
+				"max_read_message": 100,
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			config := defaultConfig
+			err = cfg.Unpack(&config)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			server, err := New(&config, OctetCountSplitFunc(config.MaxMessageSize), to)
+			if !assert.NoError(t, err) {
+				return
+			}
+			err = server.Start()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer server.Stop()
+
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			assert.NoError(t, err)
+			test.write(conn)
+			conn.Close()
+
+			var events []*info
+			for len(events) < len(test.expectedMessages) {
+				select {
+				case event := <-ch:
+					events = append(events, event)
+				default:
+				}
+			}
+
+			for idx, e := range events {
+				assert.Equal(t, test.expectedMessages[idx], e.message)
+			}
+		})
+	}
+}
+
+func TestRateLimiting(t *testing.T) {
+	const payloadSize = 20000
+	const limit = int64(10000) // bytes/sec per connection
+
+	payload := randomString(payloadSize)
+
+	ch := make(chan *info, 1)
+	defer close(ch)
+	to := func(message []byte, mt inputsource.NetworkMetadata) {
+		ch <- &info{message: string(message), mt: mt}
+	}
+
+	cfg, err := common.NewConfigFrom(map[string]interface{}{
+		"host": "localhost:0",
+		"max_bytes_per_connection_per_second": limit,
+		"max_read_message":                    payloadSize + 10,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	config := defaultConfig
+	err = cfg.Unpack(&config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	server, err := New(&config, SplitFunc([]byte("\n")), to)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = server.Start()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	start := time.Now()
+	fmt.Fprint(conn, payload+"\n")
+	conn.Close()
+
+	select {
+	case event := <-ch:
+		elapsed := time.Since(start)
+		assert.Equal(t, payload, event.message)
+
+		expected := time.Duration(float64(payloadSize) / float64(limit) * float64(time.Second))
+		assert.True(t, elapsed >= expected/2,
+			"expected the capped transfer to take at least %s, took %s", expected/2, elapsed)
+
+		stats := server.Stats()
+		assert.True(t, stats.TotalBytes >= int64(payloadSize),
+			"expected Stats().TotalBytes to account for the payload, got %d", stats.TotalBytes)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+// TestRateLimitingCombinedLimitsNotAdditive checks that when both the global
+// and per-connection limits apply to the same connection, the transfer is
+// throttled to the binding (tightest) limit, not the sum of both delays.
+func TestRateLimitingCombinedLimitsNotAdditive(t *testing.T) {
+	const payloadSize = 20000
+	const limit = int64(10000) // bytes/sec, both global and per-connection
+
+	payload := randomString(payloadSize)
+
+	ch := make(chan *info, 1)
+	defer close(ch)
+	to := func(message []byte, mt inputsource.NetworkMetadata) {
+		ch <- &info{message: string(message), mt: mt}
+	}
+
+	cfg, err := common.NewConfigFrom(map[string]interface{}{
+		"host": "localhost:0",
+		"max_bytes_per_second":                limit,
+		"max_bytes_per_connection_per_second": limit,
+		"max_read_message":                    payloadSize + 10,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	config := defaultConfig
+	err = cfg.Unpack(&config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	server, err := New(&config, SplitFunc([]byte("\n")), to)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = server.Start()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	start := time.Now()
+	fmt.Fprint(conn, payload+"\n")
+	conn.Close()
+
+	select {
+	case event := <-ch:
+		elapsed := time.Since(start)
+		assert.Equal(t, payload, event.message)
+
+		// If the two limits' delays were additive, this transfer would take
+		// roughly twice as long as a single limit alone (see
+		// TestRateLimiting). It should instead take roughly the same amount
+		// of time as enforcing just one of the two identical limits.
+		expected := time.Duration(float64(payloadSize) / float64(limit) * float64(time.Second))
+		assert.True(t, elapsed < expected*3/2,
+			"expected combined identical limits to behave like a single limit (~%s), took %s", expected, elapsed)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	tests := []struct {
+		name           string
+		overflowAction string
+	}{
+		{name: "Reject", overflowAction: OverflowActionReject},
+		{name: "Wait", overflowAction: OverflowActionWait},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			to := func(message []byte, mt inputsource.NetworkMetadata) {}
+
+			cfg, err := common.NewConfigFrom(map[string]interface{}{
+				"host":            "localhost:0",
+				"max_connections": 1,
+				"overflow_action": test.overflowAction,
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			config := defaultConfig
+			err = cfg.Unpack(&config)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			server, err := New(&config, SplitFunc([]byte("\n")), to)
+			if !assert.NoError(t, err) {
+				return
+			}
+			err = server.Start()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer server.Stop()
+
+			addr := server.Listener.Addr().String()
+
+			first, err := net.Dial("tcp", addr)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer first.Close()
+
+			// Give the accept loop time to claim the first connection's slot.
+			time.Sleep(50 * time.Millisecond)
+
+			second, err := net.Dial("tcp", addr)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer second.Close()
+
+			second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			buf := make([]byte, 1)
+			_, readErr := second.Read(buf)
+
+			switch test.overflowAction {
+			case OverflowActionReject:
+				assert.Error(t, readErr, "expected the (N+1)th connection to be closed promptly")
+			case OverflowActionWait:
+				nerr, ok := readErr.(net.Error)
+				assert.True(t, ok && nerr.Timeout(), "expected the (N+1)th connection to block until a slot frees up")
+			}
+		})
+	}
+}
+
+func TestStopDrainsWithinShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	to := func(message []byte, mt inputsource.NetworkMetadata) {
+		<-release
+	}
+
+	cfg, err := common.NewConfigFrom(map[string]interface{}{
+		"host":             "localhost:0",
+		"shutdown_timeout": "200ms",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	config := defaultConfig
+	err = cfg.Unpack(&config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	server, err := New(&config, SplitFunc([]byte("\n")), to)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = server.Start()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	fmt.Fprint(conn, "hello\n")
+
+	time.Sleep(50 * time.Millisecond) // let the callback start blocking on release
+
+	start := time.Now()
+	assert.NoError(t, server.Stop())
+	assert.True(t, time.Since(start) < time.Second, "Stop should return once the shutdown timeout elapses")
+
+	// The callback is still blocked on release, so the connection would
+	// otherwise leak forever; Stop must have force-closed it once the
+	// shutdown timeout elapsed instead of abandoning it.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err, "expected Stop to close the straggling connection rather than leaking it")
+
+	close(release)
+	conn.Close()
+}
+
+// fakeAddr is a net.Addr with an arbitrary fixed string, used to simulate
+// connections from a given remote IP without opening real sockets.
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "tcp" }
+func (a fakeAddr) String() string  { return string(a) }
+
+// fakeConn is a net.Conn stand-in whose RemoteAddr is the only method
+// connLimiter relies on; every other method panics via the nil embedded
+// net.Conn if ever called.
+type fakeConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestConnLimiterMaxConnectionsPerIP(t *testing.T) {
+	limiter := newConnLimiter(&Config{MaxConnectionsPerIP: 1, OverflowAction: OverflowActionWait})
+	done := make(chan struct{})
+	defer close(done)
+
+	addr := fakeAddr("203.0.113.1:12345")
+
+	const attempts = 50
+	var concurrent, maxConcurrent, acquired int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn := &fakeConn{addr: addr}
+			if !limiter.acquire(conn, done) {
+				return
+			}
+			defer limiter.release(conn)
+
+			atomic.AddInt32(&acquired, 1)
+			n := atomic.AddInt32(&concurrent, 1)
+			for {
+				old := atomic.LoadInt32(&maxConcurrent)
+				if n <= old || atomic.CompareAndSwapInt32(&maxConcurrent, old, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&concurrent, -1)
+		}()
+	}
+	wg.Wait()
+
+	assert.True(t, acquired > 0, "expected at least one connection to be let through")
+	assert.EqualValues(t, 1, maxConcurrent, "max_connections_per_ip=1 must never let more than one connection from the same IP run concurrently")
+}
+
+// TestConnLimiterUnparseableRemoteAddr checks that addresses net.SplitHostPort
+// can't parse are bucketed together under a single shared key, rather than
+// each bypassing max_connections_per_ip via its own private bucket.
+func TestConnLimiterUnparseableRemoteAddr(t *testing.T) {
+	limiter := newConnLimiter(&Config{MaxConnectionsPerIP: 1, OverflowAction: OverflowActionWait})
+	done := make(chan struct{})
+	defer close(done)
+
+	// These don't split cleanly into host:port (unescaped bracket, missing
+	// port, too many colons), so they would previously each get their own
+	// bucket keyed by the full, unparsed string.
+	addrs := []net.Addr{
+		fakeAddr("10.0.0.1:["),
+		fakeAddr("10.0.0.1"),
+		fakeAddr("2001:db8::1:12345"),
+	}
+
+	const attemptsPerAddr = 50
+	var concurrent, maxConcurrent, acquired int32
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		for i := 0; i < attemptsPerAddr; i++ {
+			wg.Add(1)
+			go func(addr net.Addr) {
+				defer wg.Done()
+
+				conn := &fakeConn{addr: addr}
+				if !limiter.acquire(conn, done) {
+					return
+				}
+				defer limiter.release(conn)
+
+				atomic.AddInt32(&acquired, 1)
+				n := atomic.AddInt32(&concurrent, 1)
+				for {
+					old := atomic.LoadInt32(&maxConcurrent)
+					if n <= old || atomic.CompareAndSwapInt32(&maxConcurrent, old, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&concurrent, -1)
+			}(addr)
+		}
+	}
+	wg.Wait()
+
+	assert.True(t, acquired > 0, "expected at least one connection to be let through")
+	assert.EqualValues(t, 1, maxConcurrent, "unparseable addresses must share one bucket, not bypass max_connections_per_ip")
+}
+
+type testCA struct {
+	cert     *x509.Certificate
+	key      *rsa.PrivateKey
+	certPath string
+}
+
+func generateTestCA(t *testing.T, dir, name string) testCA {
+	key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	certPath := filepath.Join(dir, name+".crt")
+	writePEM(t, certPath, "CERTIFICATE", der)
+
+	return testCA{cert: cert, key: key, certPath: certPath}
+}
+
+func generateTestCertificate(t *testing.T, dir, name string, ca testCA) (certPath, keyPath string) {
+	key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	writePEM(t, certPath, "CERTIFICATE", der)
+	writePEM(t, keyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+
+	return certPath, keyPath
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	f, err := os.Create(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer f.Close()
+
+	err = pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+}
+
 func randomString(l int) string {
 	charsets := []byte("abcdefghijklmnopqrstuvwzyzABCDEFGHIJKLMNOPQRSTUVWZYZ0123456789")
 	message := make([]byte, l)
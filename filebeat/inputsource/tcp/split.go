@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// Framing identifies the scheme used to split the incoming byte stream into
+// discrete messages.
+const (
+	// FramingDelimiter splits the stream on a configurable delimiter, e.g. a
+	// newline.
+	FramingDelimiter = "delimiter"
+
+	// FramingOctetCount splits the stream using the RFC 6587 octet counting
+	// scheme: an ASCII decimal length, a single space, then exactly that many
+	// bytes of message.
+	FramingOctetCount = "octet-counted"
+)
+
+// maxOctetCountDigits bounds how many bytes of input OctetCountSplitFunc will buffer
+// while looking for the space that terminates the length prefix, so that a
+// peer that never sends one can't grow the scan buffer unbounded.
+const maxOctetCountDigits = 10
+
+// SplitFunc returns a bufio.SplitFunc that splits the incoming stream on the
+// given delimiter. The delimiter itself is never included in the emitted
+// token.
+func SplitFunc(delimiter []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+
+		if i := bytes.Index(data, delimiter); i >= 0 {
+			return i + len(delimiter), data[0:i], nil
+		}
+
+		if atEOF {
+			return len(data), data, nil
+		}
+
+		return 0, nil, nil
+	}
+}
+
+// OctetCountSplitFunc returns a bufio.SplitFunc implementing the RFC 6587
+// octet counting transport used by many syslog and SIEM shippers: each
+// message is prefixed with its length in bytes, encoded as ASCII decimal
+// digits, followed by a single space. A frame whose length prefix, space and
+// declared message length together exceed maxMessageSize is never buffered;
+// it is reported as an error so the
+// caller can close the connection instead of misinterpreting the remaining
+// bytes as a new frame.
+func OctetCountSplitFunc(maxMessageSize int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			if len(data) > maxOctetCountDigits {
+				return 0, nil, fmt.Errorf("octet-counted frame: length prefix exceeds %d digits", maxOctetCountDigits)
+			}
+			if atEOF {
+				return 0, nil, fmt.Errorf("octet-counted frame: stream ended before the length prefix was terminated")
+			}
+			return 0, nil, nil
+		}
+
+		length, convErr := strconv.Atoi(string(data[:sp]))
+		if convErr != nil || length < 0 {
+			return 0, nil, fmt.Errorf("octet-counted frame: invalid length prefix %q", data[:sp])
+		}
+
+		frameEnd := sp + 1 + length
+
+		// The scanner's buffer has to hold the length prefix and the space in
+		// addition to the message body, so the frame as a whole - not just
+		// length - must fit within maxMessageSize.
+		if frameEnd > maxMessageSize {
+			return 0, nil, fmt.Errorf("octet-counted frame: frame of %d bytes (message of %d bytes) exceeds the %d bytes limit", frameEnd, length, maxMessageSize)
+		}
+		if len(data) < frameEnd {
+			if atEOF {
+				return 0, nil, fmt.Errorf("octet-counted frame: stream ended after %d of %d expected bytes", len(data)-sp-1, length)
+			}
+			return 0, nil, nil
+		}
+
+		return frameEnd, data[sp+1 : frameEnd], nil
+	}
+}